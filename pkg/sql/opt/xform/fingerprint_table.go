@@ -0,0 +1,112 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package xform
+
+import (
+	"hash/fnv"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+)
+
+// fingerprintTable is an open-addressing hash table specialized to the
+// memo's fingerprint -> opt.GroupID mapping, and backs memo.exprMap. A Go
+// map stores each entry in a separately-allocated bucket with per-entry
+// overhead for the hash, tophash byte and pointer chain; fingerprintTable
+// instead stores keys and values in two flat slices probed linearly, which
+// shrinks per-entry overhead at the cost of tolerating load factors only up
+// to fingerprintTableMaxLoad before growing. Group ID 0 doubles as the
+// "empty slot" marker, since it's already reserved to mean "no group" (see
+// memo.groups).
+type fingerprintTable struct {
+	keys   []fingerprint
+	values []opt.GroupID
+	count  int
+}
+
+const fingerprintTableMaxLoad = 0.75
+
+func newFingerprintTable(capacityHint int) *fingerprintTable {
+	size := 16
+	for size < capacityHint {
+		size *= 2
+	}
+	return &fingerprintTable{
+		keys:   make([]fingerprint, size),
+		values: make([]opt.GroupID, size),
+	}
+}
+
+func (t *fingerprintTable) slot(key fingerprint) int {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum64() % uint64(len(t.keys)))
+}
+
+// Get returns the group mapped to key, and whether an entry was found.
+func (t *fingerprintTable) Get(key fingerprint) (opt.GroupID, bool) {
+	i := t.slot(key)
+	for t.values[i] != 0 {
+		if t.keys[i] == key {
+			return t.values[i], true
+		}
+		i = (i + 1) % len(t.keys)
+	}
+	return 0, false
+}
+
+// Put maps key to group, growing the table first if doing so would push the
+// load factor above fingerprintTableMaxLoad.
+func (t *fingerprintTable) Put(key fingerprint, group opt.GroupID) {
+	if float64(t.count+1) > fingerprintTableMaxLoad*float64(len(t.keys)) {
+		t.grow()
+	}
+
+	i := t.slot(key)
+	for t.values[i] != 0 {
+		if t.keys[i] == key {
+			t.values[i] = group
+			return
+		}
+		i = (i + 1) % len(t.keys)
+	}
+	t.keys[i] = key
+	t.values[i] = group
+	t.count++
+}
+
+func (t *fingerprintTable) grow() {
+	old := *t
+	*t = *newFingerprintTable(len(old.keys) * 2)
+	for i, group := range old.values {
+		if group != 0 {
+			t.Put(old.keys[i], group)
+		}
+	}
+}
+
+// Len returns the number of entries stored in the table.
+func (t *fingerprintTable) Len() int {
+	return t.count
+}
+
+// ForEach calls fn once for every entry in the table. fn must not call Put
+// or Get on t.
+func (t *fingerprintTable) ForEach(fn func(key fingerprint, group opt.GroupID)) {
+	for i, group := range t.values {
+		if group != 0 {
+			fn(t.keys[i], group)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package xform
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+)
+
+// TestFingerprintTablePutGetSurvivesGrowth verifies that entries remain
+// reachable by Get after enough Put calls to force the table through
+// several grow() calls, and that ForEach visits every entry exactly once.
+func TestFingerprintTablePutGetSurvivesGrowth(t *testing.T) {
+	tbl := newFingerprintTable(0)
+
+	const n = 200
+	for i := 1; i <= n; i++ {
+		tbl.Put(fingerprint(fmt.Sprintf("fp-%d", i)), opt.GroupID(i))
+	}
+
+	if got := tbl.Len(); got != n {
+		t.Fatalf("expected %d entries, got %d", n, got)
+	}
+
+	for i := 1; i <= n; i++ {
+		group, ok := tbl.Get(fingerprint(fmt.Sprintf("fp-%d", i)))
+		if !ok || group != opt.GroupID(i) {
+			t.Fatalf("fp-%d: expected group %d, got %d (ok=%v)", i, i, group, ok)
+		}
+	}
+
+	seen := make(map[fingerprint]opt.GroupID)
+	tbl.ForEach(func(fp fingerprint, g opt.GroupID) {
+		seen[fp] = g
+	})
+	if len(seen) != n {
+		t.Fatalf("expected ForEach to visit %d entries, got %d", n, len(seen))
+	}
+}
+
+// TestMemoExprMapBackedByFingerprintTable verifies that memo.exprMap -- now
+// a *fingerprintTable rather than a Go map -- is actually consulted by
+// memoizeNormExpr and lookupGroupByFingerprint, i.e. that the table is wired
+// in rather than just populated and ignored.
+func TestMemoExprMapBackedByFingerprintTable(t *testing.T) {
+	m := newMemo()
+
+	group := m.memoizeNormExpr(memoExpr{op: opt.VariableOp, private: m.internPrivate(&opt.ColSet{})})
+	norm := m.lookupNormExpr(group)
+
+	if got, ok := m.exprMap.Get(norm.fingerprint()); !ok || got != group {
+		t.Fatalf("expected exprMap to contain the normalized fingerprint mapped to %d, got %d (ok=%v)", group, got, ok)
+	}
+
+	if got := m.lookupGroupByFingerprint(norm.fingerprint()); got != group {
+		t.Fatalf("expected lookupGroupByFingerprint to find group %d, got %d", group, got)
+	}
+}
+
+// benchFingerprints builds n distinct fingerprints, used by both the
+// fingerprintTable and map benchmarks below so they're measured against
+// identical input.
+func benchFingerprints(n int) []fingerprint {
+	fps := make([]fingerprint, n)
+	for i := range fps {
+		fps[i] = fingerprint(fmt.Sprintf("[inner-join [%d %d %d]]", i, i+1, i+2))
+	}
+	return fps
+}
+
+// 4096 entries is in the neighborhood of a memo built for one of the larger
+// TPC-H queries (e.g. Q9's eight-way join), which is the scale the request
+// asked benchmarks to target.
+const benchTableSize = 4096
+
+func BenchmarkFingerprintTablePut(b *testing.B) {
+	fps := benchFingerprints(benchTableSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tbl := newFingerprintTable(0)
+		for j, fp := range fps {
+			tbl.Put(fp, opt.GroupID(j+1))
+		}
+	}
+}
+
+func BenchmarkMapPut(b *testing.B) {
+	fps := benchFingerprints(benchTableSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := make(map[fingerprint]opt.GroupID, 0)
+		for j, fp := range fps {
+			m[fp] = opt.GroupID(j + 1)
+		}
+	}
+}
+
+func BenchmarkFingerprintTableGet(b *testing.B) {
+	fps := benchFingerprints(benchTableSize)
+	tbl := newFingerprintTable(0)
+	for j, fp := range fps {
+		tbl.Put(fp, opt.GroupID(j+1))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tbl.Get(fps[i%len(fps)])
+	}
+}
+
+func BenchmarkMapGet(b *testing.B) {
+	fps := benchFingerprints(benchTableSize)
+	m := make(map[fingerprint]opt.GroupID, len(fps))
+	for j, fp := range fps {
+		m[fp] = opt.GroupID(j + 1)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = m[fps[i%len(fps)]]
+	}
+}
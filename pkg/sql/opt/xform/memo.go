@@ -22,7 +22,6 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/sql/opt"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
-	"github.com/cockroachdb/cockroach/pkg/util/treeprinter"
 )
 
 // memoLoc describes the location of an expression in the memo, which is a
@@ -115,8 +114,9 @@ type memo struct {
 	// exprMap maps from expression fingerprint (memoExpr.fingerprint()) to
 	// that expression's group. Multiple different fingerprints can map to the
 	// same group, but only one of them is the fingerprint of the group's
-	// normalized expression.
-	exprMap map[fingerprint]opt.GroupID
+	// normalized expression. Backed by fingerprintTable, an open-addressing
+	// table specialized to this key/value shape, rather than a Go map.
+	exprMap *fingerprintTable
 
 	// groups is the set of all groups in the memo, indexed by group ID. Note
 	// the group ID 0 is invalid in order to allow zero initialization of an
@@ -148,6 +148,19 @@ type memo struct {
 	// to indicate an unknown private.
 	privatesMap map[interface{}]opt.PrivateID
 	privates    []interface{}
+
+	// scalarNum holds the cross-group value numbering state used to route
+	// semantically equivalent scalar expressions to the same group. It is
+	// allocated lazily, since most memos never canonicalize a scalar
+	// expression. See ensureValueNumbering.
+	scalarNum *scalarValueNumbering
+
+	// groupDependents maps a ListID to the set of groups referenced by that
+	// list, backed by the packed groupSet bitvector rather than a Go map so
+	// that reverse lookup during rewrites (which group IDs does this list
+	// touch?) stays cheap at TPC-H-scale memo sizes. Maintained incrementally
+	// by internList; consulted by Compact's reference-rewriting pass.
+	groupDependents map[opt.ListID]groupSet
 }
 
 func newMemo() *memo {
@@ -159,13 +172,14 @@ func newMemo() *memo {
 	// physical should never actually be accessed when traversing the normalized
 	// tree.
 	m := &memo{
-		metadata:     opt.NewMetadata(),
-		exprMap:      make(map[fingerprint]opt.GroupID),
-		groups:       make([]memoGroup, 1),
-		physPropsMap: make(map[string]opt.PhysicalPropsID),
-		physProps:    make([]opt.PhysicalProps, 2, 3),
-		privatesMap:  make(map[interface{}]opt.PrivateID),
-		privates:     make([]interface{}, 1),
+		metadata:        opt.NewMetadata(),
+		exprMap:         newFingerprintTable(0),
+		groups:          make([]memoGroup, 1),
+		physPropsMap:    make(map[string]opt.PhysicalPropsID),
+		physProps:       make([]opt.PhysicalProps, 2, 3),
+		privatesMap:     make(map[interface{}]opt.PrivateID),
+		privates:        make([]interface{}, 1),
+		groupDependents: make(map[opt.ListID]groupSet),
 	}
 
 	// Intern physical properties that require nothing of operator.
@@ -193,29 +207,49 @@ func (m *memo) newGroup(norm memoExpr) *memoGroup {
 // an alternate form of the group's normalized expression. Adding it to the
 // fingerprint map avoids re-adding the same expression in the future.
 func (m *memo) addAltFingerprint(alt fingerprint, group opt.GroupID) {
-	existing, ok := m.exprMap[alt]
+	existing, ok := m.exprMap.Get(alt)
 	if ok {
 		if existing != group {
 			panic("same fingerprint cannot map to different groups")
 		}
 	} else {
-		m.exprMap[alt] = group
+		m.exprMap.Put(alt, group)
 	}
 }
 
 // memoizeNormExpr enters a normalized expression into the memo. This requires
 // the creation of a new memo group with the normalized expression as its first
 // expression.
+// The exception is a scalar expression semantically equivalent to one
+// already memoized: it is routed to that expression's group instead.
 func (m *memo) memoizeNormExpr(norm memoExpr) opt.GroupID {
-	if m.exprMap[norm.fingerprint()] != 0 {
+	if _, ok := m.exprMap.Get(norm.fingerprint()); ok {
 		panic("normalized expression has been entered into the memo more than once")
 	}
 
+	// Before allocating a new group, check whether a semantically equivalent
+	// scalar expression has already been memoized under a different syntactic
+	// fingerprint (e.g. a+b vs b+a). If so, route norm to that group instead
+	// of creating a redundant one, and record the new fingerprint as an
+	// alternate so the same rewrite isn't repeated.
+	if semFP, ok := m.canonicalizeScalar(&norm); ok {
+		vn := m.ensureValueNumbering()
+		if group, ok := vn.classes[semFP]; ok {
+			m.addAltFingerprint(norm.fingerprint(), group)
+			return group
+		}
+	}
+
 	mgrp := m.newGroup(norm)
 	ev := makeExprView(m, mgrp.id, opt.NormPhysPropsID)
 	mgrp.logical = m.logPropsFactory.constructProps(ev)
 
-	m.exprMap[norm.fingerprint()] = mgrp.id
+	m.exprMap.Put(norm.fingerprint(), mgrp.id)
+
+	if semFP, ok := m.canonicalizeScalar(&norm); ok {
+		m.ensureValueNumbering().classes[semFP] = mgrp.id
+	}
+
 	return mgrp.id
 }
 
@@ -227,7 +261,8 @@ func (m *memo) lookupGroup(group opt.GroupID) *memoGroup {
 // lookupGroupByFingerprint returns the group of the expression that has the
 // given fingerprint.
 func (m *memo) lookupGroupByFingerprint(f fingerprint) opt.GroupID {
-	return m.exprMap[f]
+	group, _ := m.exprMap.Get(f)
+	return group
 }
 
 // lookupExpr returns the expression referenced by the given location.
@@ -247,7 +282,9 @@ func (m *memo) lookupNormExpr(group opt.GroupID) *memoExpr {
 // ID that can be used for later lookup. If the same list was added previously,
 // this method is a no-op and returns the ID of the previous value.
 func (m *memo) internList(items []opt.GroupID) opt.ListID {
-	return m.listStorage.intern(items)
+	id := m.listStorage.intern(items)
+	m.recordListDependents(id, items)
+	return id
 }
 
 // lookupList returns a list of group IDs that was earlier stored in the memo
@@ -283,16 +320,7 @@ func (m *memo) lookupPhysicalProps(id opt.PhysicalPropsID) *opt.PhysicalProps {
 // NOTE: Because the internment uses the private value as a map key, only data
 //       types which can be map types can be used here.
 func (m *memo) internPrivate(private interface{}) opt.PrivateID {
-	// Intern the value of certain Datum types rather than a pointer to their
-	// value in order to support fast value comparison by private id. This is
-	// only possible for Datum types that can be used as map types.
-	key := private
-	switch t := private.(type) {
-	case *tree.DString:
-		// Key as a string, so that it compares equal to interned string.
-		key = string(*t)
-	}
-
+	key := privateMapKey(private)
 	id, ok := m.privatesMap[key]
 	if !ok {
 		id = opt.PrivateID(len(m.privates))
@@ -302,43 +330,32 @@ func (m *memo) internPrivate(private interface{}) opt.PrivateID {
 	return id
 }
 
+// privateMapKey returns the value used to key privatesMap for the given
+// private value. Intern the value of certain Datum types rather than a
+// pointer to their value in order to support fast value comparison by
+// private id. This is only possible for Datum types that can be used as map
+// types.
+func privateMapKey(private interface{}) interface{} {
+	switch t := private.(type) {
+	case *tree.DString:
+		// Key as a string, so that it compares equal to interned string.
+		return string(*t)
+	default:
+		return private
+	}
+}
+
 // lookupPrivate returns a private value that was earlier interned in the memo
 // by a call to internPrivate.
 func (m *memo) lookupPrivate(id opt.PrivateID) interface{} {
 	return m.privates[id]
 }
 
+// String renders the memo using the default tree-printer text backend. See
+// Format for a way to render other representations (JSON, DOT) driven by
+// the same underlying walk.
 func (m *memo) String() string {
-	tp := treeprinter.New()
-	root := tp.Child("memo")
-
-	var buf bytes.Buffer
-	for i := len(m.groups) - 1; i > 0; i-- {
-		mgrp := &m.groups[i]
-
-		buf.Reset()
-		for i := range mgrp.exprs {
-			if i != 0 {
-				buf.WriteByte(' ')
-			}
-
-			// Wrap the memo expr in ExprView to make it easy to get children.
-			eid := exprID(i)
-			ev := ExprView{
-				mem:      m,
-				loc:      memoLoc{group: mgrp.id, expr: eid},
-				op:       mgrp.exprs[eid].op,
-				required: opt.MinPhysPropsID,
-			}
-
-			m.formatExpr(ev, &buf, false /* includeRequired */)
-		}
-
-		child := root.Childf("%d: %s", i, buf.String())
-		m.formatBestExprs(mgrp, child)
-	}
-
-	return tp.String()
+	return m.Format(newTextFormatter(), nil)
 }
 
 type bestExprSort struct {
@@ -347,8 +364,10 @@ type bestExprSort struct {
 	bestExpr    *bestExpr
 }
 
-func (m *memo) formatBestExprs(mgrp *memoGroup, tp treeprinter.Node) {
-	// Sort the bestExprs by required properties.
+// sortedBestExprs returns mgrp's best expressions sorted by the fingerprint
+// of their required physical properties, so every MemoFormatter backend
+// renders them in the same deterministic order.
+func (m *memo) sortedBestExprs(mgrp *memoGroup) []bestExprSort {
 	beSort := make([]bestExprSort, 0, len(mgrp.bestExprs))
 	mgrp.forEachBestExpr(func(required opt.PhysicalPropsID, best *bestExpr) {
 		beSort = append(beSort, bestExprSort{
@@ -361,21 +380,7 @@ func (m *memo) formatBestExprs(mgrp *memoGroup, tp treeprinter.Node) {
 	sort.Slice(beSort, func(i, j int) bool {
 		return strings.Compare(beSort[i].fingerprint, beSort[j].fingerprint) < 0
 	})
-
-	var buf bytes.Buffer
-	for _, be := range beSort {
-		buf.Reset()
-
-		// Don't show best expressions for scalar groups because they're not too
-		// interesting.
-		ev := makeExprView(m, mgrp.id, be.required)
-		if !ev.IsScalar() {
-			child := tp.Childf("\"%s\" [cost=0.0]", be.fingerprint)
-
-			m.formatExpr(ev, &buf, true /* includeRequired */)
-			child.Childf("best: %s", buf.String())
-		}
-	}
+	return beSort
 }
 
 func (m *memo) formatExpr(ev ExprView, buf *bytes.Buffer, includeRequired bool) {
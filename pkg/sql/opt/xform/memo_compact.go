@@ -0,0 +1,248 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package xform
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+)
+
+// groupUnionFind is a union-find (disjoint-set) structure over opt.GroupID,
+// used by Compact to decide which groups are provably equivalent and should
+// be physically merged. Find always returns the group with the lowest ID in
+// a set, so the merged memo is deterministic regardless of discovery order.
+type groupUnionFind struct {
+	parent []opt.GroupID
+}
+
+func newGroupUnionFind(numGroups int) *groupUnionFind {
+	parent := make([]opt.GroupID, numGroups)
+	for i := range parent {
+		parent[i] = opt.GroupID(i)
+	}
+	return &groupUnionFind{parent: parent}
+}
+
+func (u *groupUnionFind) find(g opt.GroupID) opt.GroupID {
+	for u.parent[g] != g {
+		// Path-halving: point each node at its grandparent to keep future
+		// finds cheap without the complexity of full path compression.
+		u.parent[g] = u.parent[u.parent[g]]
+		g = u.parent[g]
+	}
+	return g
+}
+
+// union merges the sets containing a and b, keeping the lower group ID as
+// the representative so that Compact's output is stable.
+func (u *groupUnionFind) union(a, b opt.GroupID) {
+	ra, rb := u.find(a), u.find(b)
+	if ra == rb {
+		return
+	}
+	if ra < rb {
+		u.parent[rb] = ra
+	} else {
+		u.parent[ra] = rb
+	}
+}
+
+// merge concatenates other's expressions into mgrp and unions their best
+// expressions, so that an expression discovered for either of two groups
+// that turn out to be equivalent is considered when costing mgrp's required
+// physical properties.
+func (mgrp *memoGroup) merge(other *memoGroup) {
+	mgrp.exprs = append(mgrp.exprs, other.exprs...)
+	other.forEachBestExpr(func(required opt.PhysicalPropsID, best *bestExpr) {
+		if existing, ok := mgrp.lookupBestExpr(required); !ok || best.cost < existing.cost {
+			mgrp.ensureBestExpr(required, best)
+		}
+	})
+}
+
+// Compact runs a post-exploration pass that physically merges memo groups
+// that exploration has proven equivalent -- the "tunneling" pattern used by
+// optimizing compilers to eliminate branch-to-branch redundancy once it's
+// discovered rather than only at construction time. Two groups are
+// considered equivalent when they share a scalar semantic fingerprint (see
+// scalarEquivalences) or when their logical properties agree and one
+// group's expression list is a subset of (or equal to) the other's.
+//
+// After the union-find over opt.GroupID is built, Compact rewrites every
+// memoExpr's child group list, every ListID payload in listStorage, and
+// every exprMap entry to reference the canonical representative, so no
+// stale group ID survives the pass.
+func (m *memo) Compact() {
+	uf := newGroupUnionFind(len(m.groups))
+
+	m.seedScalarEquivalences(uf)
+
+	// Seed it further with logical-properties-equal groups whose expression
+	// lists are subsets of one another -- these arise when a rule
+	// derives the same relational group two different ways.
+	for i := 1; i < len(m.groups); i++ {
+		for j := i + 1; j < len(m.groups); j++ {
+			a, b := &m.groups[i], &m.groups[j]
+			if uf.find(a.id) == uf.find(b.id) {
+				continue
+			}
+			if !a.logical.Equals(&b.logical) {
+				continue
+			}
+			if isExprSubset(a, b) || isExprSubset(b, a) {
+				uf.union(a.id, b.id)
+			}
+		}
+	}
+
+	m.applyCompaction(uf)
+}
+
+// seedScalarEquivalences unions groups whose normalized expression reduces
+// to the same semantic fingerprint (see canonicalizeScalar) AND whose
+// logical properties agree. The fingerprint alone isn't sufficient grounds
+// to merge two groups -- it only says their scalar *shape* matches modulo
+// commutativity/associativity/identity folding, not that they're the same
+// expression overall (two unrelated groups can't collide on it in practice,
+// but nothing enforces that, so the logical-properties check is load-
+// bearing, not a redundant safety net). This is the same invariant
+// applyCompaction's merge step enforces, so that a union this function
+// performs is always safe for applyCompaction to act on unconditionally.
+func (m *memo) seedScalarEquivalences(uf *groupUnionFind) {
+	byFingerprint := make(map[semanticFingerprint][]opt.GroupID)
+	for i := 1; i < len(m.groups); i++ {
+		group := opt.GroupID(i)
+		if fp, ok := m.canonicalizeScalar(m.lookupNormExpr(group)); ok {
+			byFingerprint[fp] = append(byFingerprint[fp], group)
+		}
+	}
+
+	for _, groups := range byFingerprint {
+		for i := 1; i < len(groups); i++ {
+			for j := 0; j < i; j++ {
+				a, b := groups[j], groups[i]
+				if !m.groups[a].logical.Equals(&m.groups[b].logical) {
+					continue
+				}
+				uf.union(a, b)
+			}
+		}
+	}
+}
+
+// isExprSubset returns true if every expression in sub also appears (by
+// fingerprint) in super.
+func isExprSubset(sub, super *memoGroup) bool {
+	superFPs := make(map[fingerprint]bool, len(super.exprs))
+	for i := range super.exprs {
+		superFPs[super.exprs[i].fingerprint()] = true
+	}
+	for i := range sub.exprs {
+		if !superFPs[sub.exprs[i].fingerprint()] {
+			return false
+		}
+	}
+	return true
+}
+
+// applyCompaction merges every non-canonical group into its representative
+// and rewrites all group ID references in the memo to match.
+func (m *memo) applyCompaction(uf *groupUnionFind) {
+	// remapped tracks every group that got folded into a representative, so
+	// the listStorage rewrite below can use listDependents to skip lists
+	// that don't reference any of them instead of rewriting every list in
+	// the memo unconditionally.
+	var remapped groupSet
+
+	// Merge group contents into the representative, lowest-numbered group in
+	// each equivalence class. Representatives are invariant under repeated
+	// find() calls, so it's safe to do this before rewriting references.
+	for i := len(m.groups) - 1; i > 1; i-- {
+		g := opt.GroupID(i)
+		rep := uf.find(g)
+		if rep == g {
+			continue
+		}
+		remapped.Add(g)
+		// Every union the seeding passes perform is gated on logical
+		// properties agreeing, so this should never fail. It's checked here
+		// too, as a hard invariant rather than a silent skip: the reference
+		// rewrite below redirects every remaining pointer at g to rep
+		// unconditionally, so if this pair were ever unioned without the
+		// invariant holding, skipping the merge silently would still leave
+		// the memo corrupted -- every existing reference to g would end up
+		// pointing at an unrelated group's contents. Panicking surfaces a
+		// bug in the seeding logic instead of producing a silently wrong
+		// plan.
+		if !m.groups[rep].logical.Equals(&m.groups[g].logical) {
+			panic(fmt.Sprintf(
+				"group %d unioned with %d despite disagreeing logical properties", g, rep,
+			))
+		}
+		m.groups[rep].merge(&m.groups[g])
+	}
+
+	rewrite := func(g opt.GroupID) opt.GroupID { return uf.find(g) }
+
+	// Rewrite every memoExpr's child group list.
+	for i := 1; i < len(m.groups); i++ {
+		for e := range m.groups[i].exprs {
+			expr := &m.groups[i].exprs[e]
+			children := m.listStorage.lookup(expr.children)
+			for c := range children {
+				children[c] = rewrite(children[c])
+			}
+		}
+	}
+
+	// Rewrite every ListID payload in listStorage directly, since lists are
+	// also referenced independently of any single memoExpr (e.g. by private
+	// ColList-shaped values). listDependents lets this skip the (common)
+	// case where a list doesn't reference any group that was just remapped.
+	for i := range m.listStorage.lists {
+		deps := m.listDependents(opt.ListID(i))
+		touchesRemapped := false
+		deps.ForEach(func(g opt.GroupID) {
+			if remapped.Contains(g) {
+				touchesRemapped = true
+			}
+		})
+		if !touchesRemapped {
+			continue
+		}
+		for c := range m.listStorage.lists[i] {
+			m.listStorage.lists[i][c] = rewrite(m.listStorage.lists[i][c])
+		}
+	}
+
+	// Rewrite exprMap so every fingerprint points at the canonical group.
+	// Updates are collected before being applied, since fingerprintTable
+	// doesn't support mutating an entry's value while ForEach is iterating
+	// (a Put that triggers a resize would invalidate the in-progress walk).
+	type fingerprintUpdate struct {
+		fp    fingerprint
+		group opt.GroupID
+	}
+	var updates []fingerprintUpdate
+	m.exprMap.ForEach(func(fp fingerprint, g opt.GroupID) {
+		if canon := rewrite(g); canon != g {
+			updates = append(updates, fingerprintUpdate{fp, canon})
+		}
+	})
+	for _, u := range updates {
+		m.exprMap.Put(u.fp, u.group)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package xform
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+)
+
+// TestSeedScalarEquivalencesOnlyUnionsMatchingFingerprints verifies that
+// groups with unrelated scalar shapes (e.g. a+b vs x*y) are never unioned
+// just because both happen to be scalar expressions.
+func TestSeedScalarEquivalencesOnlyUnionsMatchingFingerprints(t *testing.T) {
+	m := newMemo()
+
+	// Two distinct scalar shapes: group 1 is a "+" and group 2 is a "*".
+	// canonicalizeScalar should give them different fingerprints, so they
+	// must never end up unioned.
+	m.groups = make([]memoGroup, 3)
+	m.groups[1] = memoGroup{id: 1, exprs: []memoExpr{{op: opt.PlusOp}}}
+	m.groups[2] = memoGroup{id: 2, exprs: []memoExpr{{op: opt.MultOp}}}
+
+	uf := newGroupUnionFind(len(m.groups))
+	m.seedScalarEquivalences(uf)
+
+	if uf.find(1) == uf.find(2) {
+		t.Fatalf("expected unrelated scalar shapes (PlusOp vs MultOp) to remain in separate groups")
+	}
+}
+
+// TestSeedScalarEquivalencesRespectsLogicalPropertiesGate verifies the
+// invariant applyCompaction's merge step later panics on if it's ever
+// violated: two groups that share a semantic fingerprint (same scalar shape)
+// but disagree on logical properties must not be unioned. The fingerprint
+// match alone is only a candidate filter; it's not sufficient grounds to
+// union two groups on its own.
+func TestSeedScalarEquivalencesRespectsLogicalPropertiesGate(t *testing.T) {
+	m := newMemo()
+
+	var colsA, colsB opt.ColSet
+	colsA.Add(opt.ColumnIndex(1))
+	colsB.Add(opt.ColumnIndex(2))
+
+	// Both groups are a "+" expression, so they share a semantic fingerprint,
+	// but their logical properties (here, output columns) disagree.
+	m.groups = make([]memoGroup, 3)
+	m.groups[1] = memoGroup{
+		id:      1,
+		exprs:   []memoExpr{{op: opt.PlusOp}},
+		logical: opt.LogicalProps{OutputCols: colsA},
+	}
+	m.groups[2] = memoGroup{
+		id:      2,
+		exprs:   []memoExpr{{op: opt.PlusOp}},
+		logical: opt.LogicalProps{OutputCols: colsB},
+	}
+
+	uf := newGroupUnionFind(len(m.groups))
+	m.seedScalarEquivalences(uf)
+
+	if uf.find(1) == uf.find(2) {
+		t.Fatalf("expected groups sharing a semantic fingerprint but disagreeing logical properties to remain in separate groups")
+	}
+}
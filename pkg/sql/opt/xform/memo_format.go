@@ -0,0 +1,299 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package xform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/util/treeprinter"
+)
+
+// costModel computes the cost of a best expression for display purposes.
+// It's a placeholder seam: until the real coster is wired into the memo,
+// callers pass nil and Format substitutes a [cost=0.0] stand-in, matching
+// what memo.String has always shown.
+type costModel func(ev ExprView) float64
+
+// MemoFormatter is the set of callbacks invoked by memo.Format as it walks
+// the memo, in descending group ID order, the same order memo.String has
+// always used. Every rendering backend (text, JSON, DOT) implements this
+// interface so they're driven by one walk and can't drift out of sync with
+// each other.
+type MemoFormatter interface {
+	// BeginMemo is called once, before any group is visited.
+	BeginMemo()
+
+	// BeginGroup is called before a group's expressions and best expressions
+	// are visited.
+	BeginGroup(id opt.GroupID)
+
+	// Expr is called once for each expression memoized in the current group,
+	// normalized expression first.
+	Expr(ev ExprView)
+
+	// BestExpr is called once for each required-physical-props entry
+	// recorded for the current group; it is not called for scalar groups.
+	// cost is 0 unless a costModel hook was passed to Format.
+	BestExpr(ev ExprView, requiredFP string, cost float64)
+
+	// EndGroup is called after a group's expressions have been visited.
+	EndGroup(id opt.GroupID)
+
+	// EndMemo is called once all groups have been visited, and returns the
+	// finished rendering.
+	EndMemo() string
+}
+
+// Format walks the memo's groups in the same order memo.String always has
+// (descending group ID) and drives formatter with the result, optionally
+// consulting cost to compute each best expression's cost. Passing a nil
+// cost yields 0.0 for every best expression, which is what memo.String does
+// today.
+func (m *memo) Format(formatter MemoFormatter, cost costModel) string {
+	formatter.BeginMemo()
+	for i := len(m.groups) - 1; i > 0; i-- {
+		mgrp := &m.groups[i]
+		formatter.BeginGroup(mgrp.id)
+
+		for e := range mgrp.exprs {
+			eid := exprID(e)
+			ev := ExprView{
+				mem:      m,
+				loc:      memoLoc{group: mgrp.id, expr: eid},
+				op:       mgrp.exprs[eid].op,
+				required: opt.MinPhysPropsID,
+			}
+			formatter.Expr(ev)
+		}
+
+		// Best expressions aren't interesting for scalar groups, so they're
+		// skipped here just as memo.String has always skipped them.
+		for _, be := range m.sortedBestExprs(mgrp) {
+			ev := makeExprView(m, mgrp.id, be.required)
+			if ev.IsScalar() {
+				continue
+			}
+			costVal := 0.0
+			if cost != nil {
+				costVal = cost(ev)
+			}
+			formatter.BestExpr(ev, be.fingerprint, costVal)
+		}
+
+		formatter.EndGroup(mgrp.id)
+	}
+	return formatter.EndMemo()
+}
+
+// textFormatter reproduces memo.String's historical tree-printer output: a
+// "memo" root, one child per group listing its expressions, and one
+// grandchild per best expression.
+type textFormatter struct {
+	tp        treeprinter.Node
+	root      treeprinter.Node
+	groupID   opt.GroupID
+	buf       bytes.Buffer
+	bestExprs []textBestExpr
+}
+
+// textBestExpr buffers a rendered best expression until EndGroup, since the
+// group's treeprinter node (whose label is the joined text of its Expr
+// calls) isn't created until every Expr call for the group has been seen --
+// Format invokes BestExpr before EndGroup, so BestExpr can't assume the
+// node already exists.
+type textBestExpr struct {
+	requiredFP string
+	cost       float64
+	exprStr    string
+}
+
+func newTextFormatter() *textFormatter {
+	tp := treeprinter.New()
+	return &textFormatter{tp: tp, root: tp.Child("memo")}
+}
+
+func (f *textFormatter) BeginMemo() {}
+
+func (f *textFormatter) BeginGroup(id opt.GroupID) {
+	f.groupID = id
+	f.buf.Reset()
+	f.bestExprs = f.bestExprs[:0]
+}
+
+func (f *textFormatter) Expr(ev ExprView) {
+	if f.buf.Len() > 0 {
+		f.buf.WriteByte(' ')
+	}
+	ev.mem.formatExpr(ev, &f.buf, false /* includeRequired */)
+}
+
+func (f *textFormatter) BestExpr(ev ExprView, requiredFP string, cost float64) {
+	var buf bytes.Buffer
+	ev.mem.formatExpr(ev, &buf, true /* includeRequired */)
+	f.bestExprs = append(f.bestExprs, textBestExpr{requiredFP: requiredFP, cost: cost, exprStr: buf.String()})
+}
+
+func (f *textFormatter) EndGroup(id opt.GroupID) {
+	group := f.root.Childf("%d: %s", id, f.buf.String())
+	for _, be := range f.bestExprs {
+		child := group.Childf("\"%s\" [cost=%.1f]", be.requiredFP, be.cost)
+		child.Childf("best: %s", be.exprStr)
+	}
+}
+
+func (f *textFormatter) EndMemo() string {
+	return f.tp.String()
+}
+
+// jsonGroup, jsonExpr and jsonBestExpr describe the strict JSON schema used
+// by jsonFormatter. Stable field names let two runs of a memo dump be
+// diffed to see which alternatives a new transformation rule added or
+// removed.
+type jsonExpr struct {
+	Fingerprint string `json:"fingerprint"`
+	Private     string `json:"private,omitempty"`
+}
+
+type jsonBestExpr struct {
+	RequiredProps string  `json:"requiredProps"`
+	Cost          float64 `json:"cost"`
+	Expr          string  `json:"expr"`
+}
+
+type jsonGroup struct {
+	ID        opt.GroupID    `json:"id"`
+	Exprs     []jsonExpr     `json:"exprs"`
+	BestExprs []jsonBestExpr `json:"bestExprs"`
+}
+
+// jsonFormatter renders the memo as the JSON schema above: one entry per
+// group, each with its memoized expressions and (for non-scalar groups) its
+// best expressions and their costs.
+type jsonFormatter struct {
+	groups []jsonGroup
+	cur    jsonGroup
+}
+
+func newJSONFormatter() *jsonFormatter {
+	return &jsonFormatter{}
+}
+
+func (f *jsonFormatter) BeginMemo() {}
+
+func (f *jsonFormatter) BeginGroup(id opt.GroupID) {
+	f.cur = jsonGroup{ID: id}
+}
+
+func (f *jsonFormatter) Expr(ev ExprView) {
+	var buf bytes.Buffer
+	ev.mem.formatExpr(ev, &buf, false /* includeRequired */)
+
+	je := jsonExpr{Fingerprint: buf.String()}
+	if private := ev.Private(); private != nil {
+		je.Private = fmt.Sprintf("%v", private)
+	}
+	f.cur.Exprs = append(f.cur.Exprs, je)
+}
+
+func (f *jsonFormatter) BestExpr(ev ExprView, requiredFP string, cost float64) {
+	var buf bytes.Buffer
+	ev.mem.formatExpr(ev, &buf, true /* includeRequired */)
+
+	f.cur.BestExprs = append(f.cur.BestExprs, jsonBestExpr{
+		RequiredProps: requiredFP,
+		Cost:          cost,
+		Expr:          buf.String(),
+	})
+}
+
+func (f *jsonFormatter) EndGroup(id opt.GroupID) {
+	f.groups = append(f.groups, f.cur)
+}
+
+func (f *jsonFormatter) EndMemo() string {
+	out, err := json.MarshalIndent(struct {
+		Groups []jsonGroup `json:"groups"`
+	}{Groups: f.groups}, "", "  ")
+	if err != nil {
+		// MarshalIndent can only fail here on a type that isn't
+		// JSON-representable, which jsonGroup never is.
+		panic(err)
+	}
+	return string(out)
+}
+
+// dotFormatter renders the memo as Graphviz DOT: each group becomes a
+// cluster containing its expressions, and an edge from each memoized
+// expression to each of its child groups is labeled with the required
+// physical properties for that child, mirroring what formatExpr shows in the
+// text form. Best expressions are emitted only as comments.
+type dotFormatter struct {
+	buf       bytes.Buffer
+	groupID   opt.GroupID
+	exprIndex int
+}
+
+func newDOTFormatter() *dotFormatter {
+	return &dotFormatter{}
+}
+
+func (f *dotFormatter) BeginMemo() {
+	f.buf.WriteString("digraph memo {\n  compound=true;\n")
+}
+
+func (f *dotFormatter) BeginGroup(id opt.GroupID) {
+	f.groupID = id
+	f.exprIndex = 0
+	fmt.Fprintf(&f.buf, "  subgraph cluster_%d {\n    label=\"group %d\";\n", id, id)
+}
+
+func (f *dotFormatter) Expr(ev ExprView) {
+	nodeName := fmt.Sprintf("g%d_e%d", f.groupID, f.exprIndex)
+	fmt.Fprintf(&f.buf, "    %s [label=\"%s\"];\n", nodeName, ev.Operator())
+
+	for i := 0; i < ev.ChildCount(); i++ {
+		child := ev.ChildGroup(i)
+		required := ev.mem.physPropsFactory.constructChildProps(ev, i)
+		label := ev.mem.lookupPhysicalProps(required).Fingerprint()
+
+		// Which of the child group's exprs ends up best for these required
+		// properties isn't known yet at Expr time (that's decided by costing,
+		// not normalization), so the edge can't point at a specific g{child}_eN
+		// node without implying a particular alternative was chosen. g%d_e0 is
+		// given only because DOT requires a concrete node name to anchor the
+		// edge; lhead (paired with the compound=true set in BeginMemo) tells
+		// Graphviz to terminate the edge at the child's cluster boundary
+		// instead of visually pointing into a specific expr inside it.
+		fmt.Fprintf(&f.buf, "    %s -> g%d_e0 [label=\"%s\", lhead=\"cluster_%d\"];\n", nodeName, child, label, child)
+	}
+
+	f.exprIndex++
+}
+
+func (f *dotFormatter) BestExpr(ev ExprView, requiredFP string, cost float64) {
+	fmt.Fprintf(&f.buf, "    // best for %q: cost=%.2f\n", requiredFP, cost)
+}
+
+func (f *dotFormatter) EndGroup(id opt.GroupID) {
+	f.buf.WriteString("  }\n")
+}
+
+func (f *dotFormatter) EndMemo() string {
+	f.buf.WriteString("}\n")
+	return f.buf.String()
+}
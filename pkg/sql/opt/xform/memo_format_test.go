@@ -0,0 +1,63 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package xform
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+)
+
+// TestTextFormatterBestExprAttachesToOwnGroup ensures a BestExpr recorded
+// for a group is rendered under that group's node, not the previously
+// visited group's (or, for the first group visited, a zero-value node that
+// would panic). Format visits BestExpr before EndGroup for a given group, so
+// the formatter must not depend on EndGroup having already run.
+func TestTextFormatterBestExprAttachesToOwnGroup(t *testing.T) {
+	mem := &memo{}
+	leaf := func(op opt.Operator) ExprView {
+		return ExprView{mem: mem, op: op, required: opt.MinPhysPropsID}
+	}
+
+	f := newTextFormatter()
+
+	f.BeginGroup(2)
+	f.Expr(leaf(opt.VariableOp))
+	f.BestExpr(leaf(opt.VariableOp), "fp-2", 1.5)
+	f.EndGroup(2)
+
+	f.BeginGroup(1)
+	f.Expr(leaf(opt.ConstOp))
+	f.BestExpr(leaf(opt.ConstOp), "fp-1", 0.5)
+	f.EndGroup(1)
+
+	out := f.EndMemo()
+
+	idx2 := strings.Index(out, "2:")
+	idxFP2 := strings.Index(out, "fp-2")
+	idx1 := strings.Index(out, "1:")
+	idxFP1 := strings.Index(out, "fp-1")
+
+	if idx2 < 0 || idxFP2 < 0 || idx1 < 0 || idxFP1 < 0 {
+		t.Fatalf("expected output to contain both groups and their best exprs, got:\n%s", out)
+	}
+	if !(idx2 < idxFP2 && idxFP2 < idx1) {
+		t.Errorf("expected group 2's best expr (fp-2) to appear after group 2's header and before group 1's, got:\n%s", out)
+	}
+	if idxFP1 < idx1 {
+		t.Errorf("expected group 1's best expr (fp-1) to appear after group 1's own header, got:\n%s", out)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package xform
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+)
+
+// privateTypeCode identifies the concrete Go type stored in an
+// opt.PrivateID slot, so Marshal can record which decoder Unmarshal should
+// use to reconstruct the interface{} value. The zero value is reserved to
+// catch a private that was never registered.
+type privateTypeCode uint8
+
+const (
+	_ privateTypeCode = iota
+	privateTypeDString
+	privateTypeScanOpDef
+	privateTypeColSet
+	privateTypeColMap
+	privateTypeColList
+	privateTypeColumnIndex
+	privateTypeRaw
+)
+
+// privateTypeCodeOf returns the type code for a private value; decodePrivate
+// below is the inverse, decoding the gob-encoded bytes for that code back
+// into the original interface{} value. Adding a new private type to the
+// memo requires registering it in both places: Marshal refuses to serialize
+// a private whose type isn't registered, since silently dropping it would
+// produce a memo that can't be unmarshaled back to an equivalent plan.
+func privateTypeCodeOf(private interface{}) (privateTypeCode, error) {
+	switch private.(type) {
+	case *tree.DString:
+		return privateTypeDString, nil
+	case *opt.ScanOpDef:
+		return privateTypeScanOpDef, nil
+	case *opt.ColSet:
+		return privateTypeColSet, nil
+	case *opt.ColMap:
+		return privateTypeColMap, nil
+	case *opt.ColList:
+		return privateTypeColList, nil
+	case opt.ColumnIndex:
+		return privateTypeColumnIndex, nil
+	default:
+		return 0, fmt.Errorf("memo: no serialization registered for private type %T", private)
+	}
+}
+
+// memoHeader is the envelope written ahead of the memo payload. schemaFP
+// pins the serialized memo to the set of table/column descriptor versions
+// it was built against; Unmarshal refuses to return a memo whose schemaFP
+// doesn't match the caller's current fingerprint, since the cached best
+// expressions (e.g. a *opt.ScanOpDef's index choice) are only valid for the
+// schema they were costed against.
+type memoHeader struct {
+	SchemaFP string
+}
+
+// encodedExpr mirrors memoExpr in a form gob can encode: children and
+// private are stored as their raw IDs, which remain valid across a
+// round-trip because Marshal/Unmarshal never renumber groups, lists or
+// privates.
+type encodedExpr struct {
+	Op       opt.Operator
+	Children opt.ListID
+	Private  opt.PrivateID
+}
+
+// encodedBestExpr mirrors bestExpr in a form gob can encode, the same way
+// encodedExpr mirrors memoExpr: children and private are stored as their raw
+// IDs, which remain valid across a round-trip because Marshal/Unmarshal
+// never renumber groups, lists or privates. Required identifies which of the
+// group's best expressions this is, since a group can have one per distinct
+// set of required physical properties.
+type encodedBestExpr struct {
+	Required opt.PhysicalPropsID
+	Op       opt.Operator
+	Children opt.ListID
+	Private  opt.PrivateID
+	Cost     float64
+}
+
+type encodedGroup struct {
+	Exprs []encodedExpr
+
+	// Logical and BestExprs are round-tripped so that a memo restored by
+	// UnmarshalMemo doesn't need to rerun exploration and costing before it
+	// can be used: Logical is what Compact's equivalence checks gate on
+	// (zero-value logical properties would make unrelated restored groups
+	// compare equal), and BestExprs is the whole point of caching a memo in
+	// the first place -- without it, PlanCache.Get would hand back a memo
+	// with nothing costed.
+	Logical   opt.LogicalProps
+	BestExprs []encodedBestExpr
+}
+
+type encodedPrivate struct {
+	Code privateTypeCode
+	Data []byte
+}
+
+type encodedMemo struct {
+	Header    memoHeader
+	Groups    []encodedGroup
+	ExprMap   map[fingerprint]opt.GroupID
+	Lists     [][]opt.GroupID
+	PhysProps []opt.PhysicalProps
+	Privates  []encodedPrivate
+}
+
+// Marshal persists the full memo -- groups (including each group's logical
+// properties and costed best expressions), exprMap, listStorage, physProps
+// and privates -- along with a fingerprint of the schema it was built
+// against. The result can be cached keyed by the normalized SQL AST (see
+// PlanCache) and later re-costed for a different set of placeholder values
+// without rerunning normalization or exploration, as long as the schema
+// fingerprint still matches.
+func (m *memo) Marshal(w io.Writer) error {
+	enc := encodedMemo{
+		Header:    memoHeader{SchemaFP: m.metadata.SchemaFingerprint()},
+		Groups:    make([]encodedGroup, len(m.groups)),
+		ExprMap:   make(map[fingerprint]opt.GroupID, m.exprMap.Len()),
+		Lists:     m.listStorage.lists,
+		PhysProps: m.physProps,
+		Privates:  make([]encodedPrivate, len(m.privates)),
+	}
+
+	// exprMap is a *fingerprintTable rather than a Go map (see fingerprint_
+	// table.go), so it's flattened into a map here for gob-friendliness and
+	// rebuilt into a fingerprintTable on the way back in by UnmarshalMemo.
+	m.exprMap.ForEach(func(fp fingerprint, g opt.GroupID) {
+		enc.ExprMap[fp] = g
+	})
+
+	for i := range m.groups {
+		mgrp := &m.groups[i]
+
+		exprs := make([]encodedExpr, len(mgrp.exprs))
+		for j, e := range mgrp.exprs {
+			exprs[j] = encodedExpr{Op: e.op, Children: e.children, Private: e.private}
+		}
+
+		var bestExprs []encodedBestExpr
+		mgrp.forEachBestExpr(func(required opt.PhysicalPropsID, best *bestExpr) {
+			bestExprs = append(bestExprs, encodedBestExpr{
+				Required: required,
+				Op:       best.op,
+				Children: best.children,
+				Private:  best.private,
+				Cost:     best.cost,
+			})
+		})
+
+		enc.Groups[i] = encodedGroup{Exprs: exprs, Logical: mgrp.logical, BestExprs: bestExprs}
+	}
+
+	// Private 0 is the reserved "no private" sentinel and is never encoded.
+	for i := 1; i < len(m.privates); i++ {
+		code, err := privateTypeCodeOf(m.privates[i])
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(m.privates[i]); err != nil {
+			return fmt.Errorf("memo: encoding private %d: %v", i, err)
+		}
+		enc.Privates[i] = encodedPrivate{Code: code, Data: buf.Bytes()}
+	}
+
+	return gob.NewEncoder(w).Encode(&enc)
+}
+
+// UnmarshalMemo reconstructs a memo previously written by Marshal. Group
+// IDs, list IDs and physical props IDs are preserved verbatim, so any
+// bestExpr cached alongside the memo by the caller (e.g. in a PlanCache
+// entry) remains valid without needing to be recomputed.
+//
+// schemaFP is the caller's current schema fingerprint (see
+// opt.Metadata.SchemaFingerprint); if it doesn't match the fingerprint
+// recorded when the memo was marshaled, UnmarshalMemo returns an error
+// rather than a memo that might reference a dropped index or altered
+// column.
+func UnmarshalMemo(r io.Reader, schemaFP string) (*memo, error) {
+	var enc encodedMemo
+	if err := gob.NewDecoder(r).Decode(&enc); err != nil {
+		return nil, fmt.Errorf("memo: decoding: %v", err)
+	}
+	if enc.Header.SchemaFP != schemaFP {
+		return nil, fmt.Errorf(
+			"memo: schema fingerprint mismatch: cached %q, current %q",
+			enc.Header.SchemaFP, schemaFP,
+		)
+	}
+
+	m := newMemo()
+	m.exprMap = newFingerprintTable(len(enc.ExprMap))
+	for fp, g := range enc.ExprMap {
+		m.exprMap.Put(fp, g)
+	}
+	m.listStorage.lists = enc.Lists
+
+	// groupDependents is normally maintained by internList, which restored
+	// lists bypass, so rebuild it here; Compact relies on it to find which
+	// lists reference a remapped group.
+	for i, items := range m.listStorage.lists {
+		m.recordListDependents(opt.ListID(i), items)
+	}
+
+	// m.physProps is restored wholesale from the payload, so physPropsMap --
+	// the index internPhysicalProps dedupes against -- has to be rebuilt to
+	// match; newMemo only seeded it for the single entry it interned itself,
+	// which enc.PhysProps is about to overwrite.
+	m.physProps = enc.PhysProps
+	m.physPropsMap = make(map[string]opt.PhysicalPropsID, len(m.physProps))
+	for i := 2; i < len(m.physProps); i++ {
+		m.physPropsMap[m.physProps[i].Fingerprint()] = opt.PhysicalPropsID(i)
+	}
+
+	m.privates = make([]interface{}, len(enc.Privates))
+	m.privatesMap = make(map[interface{}]opt.PrivateID, len(enc.Privates))
+	for i, ep := range enc.Privates {
+		if i == 0 {
+			continue
+		}
+		private, err := decodePrivate(ep)
+		if err != nil {
+			return nil, fmt.Errorf("memo: decoding private %d: %v", i, err)
+		}
+		m.privates[i] = private
+		m.privatesMap[privateMapKey(private)] = opt.PrivateID(i)
+	}
+
+	m.groups = make([]memoGroup, len(enc.Groups))
+	for i, eg := range enc.Groups {
+		if i == 0 {
+			continue
+		}
+		exprs := make([]memoExpr, len(eg.Exprs))
+		for j, ee := range eg.Exprs {
+			exprs[j] = memoExpr{op: ee.Op, children: ee.Children, private: ee.Private}
+		}
+		m.groups[i] = memoGroup{id: opt.GroupID(i), exprs: exprs, logical: eg.Logical}
+
+		for _, eb := range eg.BestExprs {
+			m.groups[i].ensureBestExpr(eb.Required, &bestExpr{
+				op:       eb.Op,
+				children: eb.Children,
+				private:  eb.Private,
+				cost:     eb.Cost,
+			})
+		}
+	}
+
+	return m, nil
+}
+
+func decodePrivate(ep encodedPrivate) (interface{}, error) {
+	buf := bytes.NewBuffer(ep.Data)
+
+	switch ep.Code {
+	case privateTypeDString:
+		var v tree.DString
+		err := gob.NewDecoder(buf).Decode(&v)
+		return &v, err
+	case privateTypeScanOpDef:
+		var v opt.ScanOpDef
+		err := gob.NewDecoder(buf).Decode(&v)
+		return &v, err
+	case privateTypeColSet:
+		var v opt.ColSet
+		err := gob.NewDecoder(buf).Decode(&v)
+		return &v, err
+	case privateTypeColMap:
+		var v opt.ColMap
+		err := gob.NewDecoder(buf).Decode(&v)
+		return &v, err
+	case privateTypeColList:
+		var v opt.ColList
+		err := gob.NewDecoder(buf).Decode(&v)
+		return &v, err
+	case privateTypeColumnIndex:
+		var v opt.ColumnIndex
+		err := gob.NewDecoder(buf).Decode(&v)
+		return v, err
+	default:
+		return nil, fmt.Errorf("unrecognized private type code %d", ep.Code)
+	}
+}
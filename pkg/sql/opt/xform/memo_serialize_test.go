@@ -0,0 +1,102 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package xform
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+)
+
+// TestUnmarshalMemoRebuildsInternMaps verifies that a memo produced by
+// UnmarshalMemo still dedupes on intern calls against the private and
+// physical-props values it was restored with, instead of appending
+// duplicate entries because physPropsMap/privatesMap were left empty.
+func TestUnmarshalMemoRebuildsInternMaps(t *testing.T) {
+	m := newMemo()
+	s := tree.DString("hello")
+	wantID := m.internPrivate(&s)
+
+	var buf bytes.Buffer
+	if err := m.Marshal(&buf); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	schemaFP := m.metadata.SchemaFingerprint()
+	restored, err := UnmarshalMemo(&buf, schemaFP)
+	if err != nil {
+		t.Fatalf("UnmarshalMemo failed: %v", err)
+	}
+
+	s2 := tree.DString("hello")
+	gotID := restored.internPrivate(&s2)
+	if gotID != wantID {
+		t.Errorf("expected interning an equal *tree.DString after Unmarshal to reuse id %d, got %d", wantID, gotID)
+	}
+	if len(restored.privates) != len(m.privates) {
+		t.Errorf("expected Unmarshal not to append a duplicate private entry, got %d entries, want %d",
+			len(restored.privates), len(m.privates))
+	}
+
+	props := opt.PhysicalProps{}
+	wantPropsID := m.internPhysicalProps(&props)
+	gotPropsID := restored.internPhysicalProps(&props)
+	if gotPropsID != wantPropsID {
+		t.Errorf("expected interning equal physical props after Unmarshal to reuse id %d, got %d",
+			wantPropsID, gotPropsID)
+	}
+}
+
+// TestMarshalRoundTripsLogicalAndBestExprs verifies that a group's logical
+// properties and costed best expressions survive a Marshal/Unmarshal cycle.
+// Without this, every memo that comes back out of a PlanCache.Get would have
+// to be fully re-explored and re-costed before it could be used, and
+// Compact's logical-properties equivalence check would trivially succeed for
+// any two restored groups since they'd all carry the zero value.
+func TestMarshalRoundTripsLogicalAndBestExprs(t *testing.T) {
+	m := newMemo()
+
+	group := m.memoizeNormExpr(memoExpr{op: opt.VariableOp, private: m.internPrivate(&tree.DString{})})
+	mgrp := m.lookupGroup(group)
+
+	wantBest := &bestExpr{op: opt.VariableOp, cost: 4.5}
+	mgrp.ensureBestExpr(opt.MinPhysPropsID, wantBest)
+
+	var buf bytes.Buffer
+	if err := m.Marshal(&buf); err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	schemaFP := m.metadata.SchemaFingerprint()
+	restored, err := UnmarshalMemo(&buf, schemaFP)
+	if err != nil {
+		t.Fatalf("UnmarshalMemo failed: %v", err)
+	}
+
+	restoredGrp := restored.lookupGroup(group)
+	if !restoredGrp.logical.Equals(&mgrp.logical) {
+		t.Errorf("expected restored group's logical properties to equal the original's")
+	}
+
+	gotBest, ok := restoredGrp.lookupBestExpr(opt.MinPhysPropsID)
+	if !ok {
+		t.Fatalf("expected restored group to have a best expr for MinPhysPropsID")
+	}
+	if gotBest.cost != wantBest.cost || gotBest.op != wantBest.op {
+		t.Errorf("expected restored best expr %+v, got %+v", wantBest, gotBest)
+	}
+}
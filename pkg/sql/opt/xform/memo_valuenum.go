@@ -0,0 +1,236 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package xform
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+)
+
+// semanticFingerprint identifies the equivalence class of a scalar
+// expression once the degrees of freedom that don't affect its value have
+// been canonicalized away: the order of commutative operands, the grouping
+// of associative chains, and constant-only subtrees that fold away to an
+// operator's identity element. Two scalar memoExprs with different
+// fingerprint() values can still share a semanticFingerprint -- e.g.
+// "a+b", "b+a" and "(a+0)+b" all reduce to the same one -- and
+// memoizeNormExpr uses that to route them into a single opt.GroupID.
+type semanticFingerprint string
+
+// scalarValueNumbering is the bookkeeping memoizeNormExpr consults before
+// allocating a new group for a scalar expression. It maps semantic
+// fingerprints to the canonical group that was first created for them. It
+// keeps no record of the alternate fingerprints folded into a group; those
+// are recorded only in memo.exprMap (fingerprint to group) by
+// addAltFingerprint, and there is no lookup from a group to its alternates.
+type scalarValueNumbering struct {
+	// classes maps a semantic fingerprint to the canonical group that
+	// represents every scalar expression sharing it.
+	classes map[semanticFingerprint]opt.GroupID
+
+	// visiting detects cycles that can arise when a rewrite rule re-derives
+	// an expression in terms of a group that is itself being canonicalized.
+	// Without this guard, such a cycle could fuse two groups that are not
+	// actually equivalent.
+	visiting map[opt.GroupID]bool
+}
+
+// ensureValueNumbering lazily initializes the memo's value-numbering state.
+// Most memos never canonicalize a scalar expression (e.g. DDL-only memos),
+// so the maps are allocated on first use rather than in newMemo.
+func (m *memo) ensureValueNumbering() *scalarValueNumbering {
+	if m.scalarNum == nil {
+		m.scalarNum = &scalarValueNumbering{
+			classes:  make(map[semanticFingerprint]opt.GroupID),
+			visiting: make(map[opt.GroupID]bool),
+		}
+	}
+	return m.scalarNum
+}
+
+// canonicalizeScalar computes the semantic fingerprint of the given scalar
+// memoExpr, whose children are assumed to already be memoized groups. It
+// returns ok=false for operators that isScalarOp doesn't recognize. Variable
+// and constant leaves do get a fingerprint, made of their operator and
+// private ID only.
+func (m *memo) canonicalizeScalar(e *memoExpr) (fp semanticFingerprint, ok bool) {
+	if !isScalarOp(e.op) {
+		return "", false
+	}
+
+	vn := m.ensureValueNumbering()
+	children := m.lookupList(e.children)
+
+	// Associative chains (e.g. (a+b)+c) are rewritten into a canonical
+	// left-deep form by flattening same-op children and re-sorting.
+	if isAssociativeOp(e.op) {
+		children = m.flattenAssociative(e.op, children, vn)
+	}
+
+	// Drop operands that are the operator's identity element, e.g. the 0 in
+	// a+0 or the 1 in a*1. This is what lets "(a+0)+b" fingerprint the same
+	// as "a+b" even though the factory's normal form doesn't always catch
+	// the cancellation on its own (e.g. when it arises from substitution
+	// deep inside a larger rewrite).
+	children = m.foldIdentities(e.op, children)
+
+	// Commutative operators are only equivalent to their operand-swapped
+	// form, so sort children by group ID for a stable, order-independent
+	// fingerprint.
+	if isCommutativeOp(e.op) {
+		children = append([]opt.GroupID(nil), children...)
+		sort.Slice(children, func(i, j int) bool { return children[i] < children[j] })
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d", e.op)
+	for _, child := range children {
+		fmt.Fprintf(&buf, " %d", child)
+	}
+	if private := e.private; private != 0 {
+		fmt.Fprintf(&buf, " p%d", private)
+	}
+	return semanticFingerprint(buf.String()), true
+}
+
+// flattenAssociative rewrites a chain of the same associative operator into
+// a single canonical left-deep list of leaf operands, so that (a+b)+c and
+// a+(b+c) both flatten to the operand list [a b c] before sorting.
+func (m *memo) flattenAssociative(
+	op opt.Operator, children []opt.GroupID, vn *scalarValueNumbering,
+) []opt.GroupID {
+	var flat []opt.GroupID
+	for _, child := range children {
+		if vn.visiting[child] {
+			// A cycle means this child can't be safely descended into; treat
+			// it as an opaque leaf rather than risk fusing unrelated groups.
+			flat = append(flat, child)
+			continue
+		}
+
+		childExpr := m.lookupNormExpr(child)
+		if childExpr.op == op {
+			vn.visiting[child] = true
+			flat = append(flat, m.flattenAssociative(op, m.lookupList(childExpr.children), vn)...)
+			delete(vn.visiting, child)
+		} else {
+			flat = append(flat, child)
+		}
+	}
+	return flat
+}
+
+// foldIdentities drops operands that are constants equal to op's identity
+// element (0 for +, 1 for *, etc). If every operand would fold away, the
+// original list is returned unchanged, since that's not a case this layer
+// should resolve (it's not a scalar expression's job to decide its own
+// default value).
+func (m *memo) foldIdentities(op opt.Operator, children []opt.GroupID) []opt.GroupID {
+	identity, ok := identityConstFor(op)
+	if !ok {
+		return children
+	}
+
+	folded := make([]opt.GroupID, 0, len(children))
+	for _, child := range children {
+		if m.isConstValue(child, identity) {
+			continue
+		}
+		folded = append(folded, child)
+	}
+	if len(folded) == 0 {
+		return children
+	}
+	return folded
+}
+
+// scalarEquivalences returns a copy of the current equivalence classes
+// discovered by value numbering, keyed by semantic fingerprint and mapping
+// to each class's canonical group.
+func (m *memo) scalarEquivalences() map[semanticFingerprint]opt.GroupID {
+	vn := m.ensureValueNumbering()
+	classes := make(map[semanticFingerprint]opt.GroupID, len(vn.classes))
+	for fp, group := range vn.classes {
+		classes[fp] = group
+	}
+	return classes
+}
+
+// isScalarOp, isCommutativeOp, isAssociativeOp and identityConstFor classify
+// the handful of scalar operators value numbering knows how to canonicalize.
+// Operators outside this small set are passed through unchanged, since an
+// incorrect classification here (unlike an incomplete one) could fuse
+// groups that aren't actually equivalent.
+func isScalarOp(op opt.Operator) bool {
+	switch op {
+	case opt.VariableOp, opt.ConstOp, opt.EqOp, opt.PlusOp, opt.MinusOp,
+		opt.MultOp, opt.AndOp, opt.OrOp, opt.NotOp:
+		return true
+	default:
+		return false
+	}
+}
+
+func isCommutativeOp(op opt.Operator) bool {
+	switch op {
+	case opt.PlusOp, opt.MultOp, opt.AndOp, opt.OrOp, opt.EqOp:
+		return true
+	default:
+		return false
+	}
+}
+
+func isAssociativeOp(op opt.Operator) bool {
+	switch op {
+	case opt.PlusOp, opt.MultOp, opt.AndOp, opt.OrOp:
+		return true
+	default:
+		return false
+	}
+}
+
+// identityConstFor returns op's identity element as an int64, matching the
+// value tree.DInt constants hold, since that's the representation integer
+// literals are actually interned under (see internPrivate and isConstValue).
+func identityConstFor(op opt.Operator) (identity int64, ok bool) {
+	switch op {
+	case opt.PlusOp:
+		return 0, true
+	case opt.MultOp:
+		return 1, true
+	default:
+		return 0, false
+	}
+}
+
+// isConstValue returns true if group's normalized expression is a ConstOp
+// whose private value is a *tree.DInt equal to want. Integer literals are
+// interned as *tree.DInt (see factory.go), not as raw Go integers, so want
+// must be unwrapped through that type rather than compared directly.
+func (m *memo) isConstValue(group opt.GroupID, want int64) bool {
+	expr := m.lookupNormExpr(group)
+	if expr.op != opt.ConstOp {
+		return false
+	}
+	d, ok := m.lookupPrivate(expr.private).(*tree.DInt)
+	if !ok {
+		return false
+	}
+	return int64(*d) == want
+}
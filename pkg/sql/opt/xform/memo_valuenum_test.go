@@ -0,0 +1,49 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package xform
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+)
+
+// TestFoldIdentitiesUnwrapsDInt verifies that an operand interned as
+// *tree.DInt (the real representation for an integer literal, per
+// internPrivate) equal to an operator's identity element is recognized and
+// folded away. Comparing against a raw int64 instead of unwrapping the
+// *tree.DInt would never match, silently disabling identity folding.
+func TestFoldIdentitiesUnwrapsDInt(t *testing.T) {
+	m := newMemo()
+
+	zero := tree.DInt(0)
+	zeroPrivate := m.internPrivate(&zero)
+	zeroGroup := m.memoizeNormExpr(memoExpr{op: opt.ConstOp, private: zeroPrivate})
+
+	a := m.memoizeNormExpr(memoExpr{op: opt.VariableOp, private: m.internPrivate(&tree.DString{})})
+	if !m.isConstValue(zeroGroup, 0) {
+		t.Fatalf("expected a *tree.DInt(0) group to be recognized as the additive identity")
+	}
+	if m.isConstValue(a, 0) {
+		t.Fatalf("expected a variable group to not be recognized as a constant")
+	}
+
+	children := m.internList([]opt.GroupID{a, zeroGroup})
+	folded := m.foldIdentities(opt.PlusOp, m.lookupList(children))
+	if len(folded) != 1 || folded[0] != a {
+		t.Fatalf("expected a+0 to fold down to just [a], got %v", folded)
+	}
+}
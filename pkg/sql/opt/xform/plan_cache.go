@@ -0,0 +1,117 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package xform
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+)
+
+// PlanCache caches normalized and explored memos, keyed by a hash of the
+// normalized SQL AST (i.e. with placeholders left unbound), so a prepared
+// statement can be re-costed for a new set of parameter values without
+// rerunning normalization or exploration. Entries are bounded by an LRU
+// policy, since a long-lived session can prepare arbitrarily many distinct
+// statements over its lifetime.
+type PlanCache struct {
+	mu struct {
+		sync.Mutex
+		entries  map[string]*list.Element
+		eviction *list.List
+	}
+	maxEntries int
+}
+
+// planCacheEntry is the value stored at each list.Element; it keeps the key
+// alongside the memo bytes so eviction in Put can remove the corresponding
+// map entry.
+type planCacheEntry struct {
+	key      string
+	schemaFP string
+	memo     []byte
+}
+
+// NewPlanCache creates a PlanCache that retains at most maxEntries memos,
+// evicting the least-recently-used entry once that limit is reached.
+func NewPlanCache(maxEntries int) *PlanCache {
+	c := &PlanCache{maxEntries: maxEntries}
+	c.mu.entries = make(map[string]*list.Element)
+	c.mu.eviction = list.New()
+	return c
+}
+
+// Put serializes mem via Marshal and stores it under key, evicting the
+// least-recently-used entry first if the cache is full. An error from
+// Marshal (e.g. an unregistered private type) is returned without modifying
+// the cache.
+func (c *PlanCache) Put(key string, mem *memo) error {
+	var buf bytes.Buffer
+	if err := mem.Marshal(&buf); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.mu.entries[key]; ok {
+		c.mu.eviction.Remove(elem)
+		delete(c.mu.entries, key)
+	}
+
+	entry := &planCacheEntry{key: key, schemaFP: mem.metadata.SchemaFingerprint(), memo: buf.Bytes()}
+	c.mu.entries[key] = c.mu.eviction.PushFront(entry)
+
+	for c.mu.eviction.Len() > c.maxEntries {
+		oldest := c.mu.eviction.Back()
+		c.mu.eviction.Remove(oldest)
+		delete(c.mu.entries, oldest.Value.(*planCacheEntry).key)
+	}
+
+	return nil
+}
+
+// Get looks up the memo cached under key and unmarshals it, validating that
+// it was built against the given schema fingerprint. A cache miss (key not
+// present) or a stale entry (schema fingerprint no longer matches) both
+// return ok=false; the caller falls back to normalizing and exploring the
+// query from scratch.
+func (c *PlanCache) Get(key string, schemaFP string) (mem *memo, ok bool) {
+	c.mu.Lock()
+	elem, found := c.mu.entries[key]
+	if found {
+		c.mu.eviction.MoveToFront(elem)
+	}
+	c.mu.Unlock()
+
+	if !found {
+		return nil, false
+	}
+
+	entry := elem.Value.(*planCacheEntry)
+	if entry.schemaFP != schemaFP {
+		c.mu.Lock()
+		c.mu.eviction.Remove(elem)
+		delete(c.mu.entries, key)
+		c.mu.Unlock()
+		return nil, false
+	}
+
+	mem, err := UnmarshalMemo(bytes.NewReader(entry.memo), schemaFP)
+	if err != nil {
+		return nil, false
+	}
+	return mem, true
+}